@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"syscall"
 
+	"github.com/araddon/dataux/pkg/backends/elasticsearch"
 	"github.com/araddon/dataux/pkg/models"
 	"github.com/araddon/dataux/pkg/proxy"
 	mysqlproxy "github.com/araddon/dataux/vendor/mixer/proxy"
@@ -38,6 +39,9 @@ func main() {
 		u.Errorf("Could not load config: %v", err)
 		os.Exit(1)
 	}
+	// Backend handlers for schemas that are not mysql
+	models.HandlerRegister(elasticsearch.ListenerType, elasticsearch.NewHandlerElasticsearch)
+
 	mysqlShardedHandler, err := mysqlproxy.NewHandlerSharded(conf)
 	if err != nil {
 		u.Errorf("Could not create handlers: %v", err)
@@ -1,8 +1,17 @@
 package elasticsearch
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/araddon/dataux/pkg/models"
+	"github.com/araddon/dataux/vendor/mixer/mysql"
+	"github.com/araddon/dataux/vendor/mixer/sqlparser"
 	u "github.com/araddon/gou"
 	"github.com/araddon/qlbridge/vm"
 )
@@ -38,6 +47,15 @@ var _ = u.EMPTY
 
 const ListenerType = "elasticsearch"
 
+var (
+	// Ensure that we implement the interfaces we expect
+	_ models.Handler        = (*HandlerElasticsearch)(nil)
+	_ models.HandlerSession = (*HandlerElasticsearch)(nil)
+
+	// Http client used to talk to elasticsearch
+	EsClient = &http.Client{Timeout: 60 * time.Second}
+)
+
 // Handle request splitting, a single connection session
 // not threadsafe, not shared
 type HandlerElasticsearch struct {
@@ -45,6 +63,8 @@ type HandlerElasticsearch struct {
 	nodes   map[string]*models.BackendConfig
 	schemas map[string]*models.Schema
 	schema  *models.Schema
+	// the schemas the user of the connection may use, nil for all
+	grants models.SchemaGrants
 }
 
 func NewHandlerElasticsearch(conf *models.Config) (models.Handler, error) {
@@ -64,14 +84,22 @@ func (m *HandlerElasticsearch) Init() error {
 	return nil
 }
 
+// Clone a session specific handler, the nodes/schemas are shared
+// but the current schema is per connection
+func (m *HandlerElasticsearch) Clone(conn interface{}) models.Handler {
+	handler := *m
+	handler.schema = nil
+	handler.grants, _ = conn.(models.SchemaGrants)
+	return &handler
+}
+
 func (m *HandlerElasticsearch) Close() error {
 	return nil
 }
 
 func (m *HandlerElasticsearch) Handle(writer models.ResultWriter, req *models.Request) error {
-	u.Infof("Handle: %v", string(req.Raw))
-	//return m.chooseCommand(writer, req)
-	return nil
+	u.Debugf("Handle: %v", string(req.Raw))
+	return m.chooseCommand(writer, req)
 }
 
 func (m *HandlerElasticsearch) SchemaUse(db string) *models.Schema {
@@ -97,8 +125,23 @@ func (m *HandlerElasticsearch) loadSchemasFromConfig() error {
 			return fmt.Errorf("schema '%s' must have at least one node", schemaConf.DB)
 		}
 
+		if schemaConf.BackendType != ListenerType {
+			continue
+		}
+
+		nodes := make(map[string]*models.BackendConfig)
+		for _, bename := range schemaConf.Backends {
+			be, ok := m.nodes[bename]
+			if !ok {
+				return fmt.Errorf("schema '%s' node '%s' config does not exist", schemaConf.DB, bename)
+			}
+			nodes[bename] = be
+		}
+
 		schema := &models.Schema{
-			Db: schemaConf.DB,
+			Db:    schemaConf.DB,
+			Nodes: nodes,
+			Conf:  schemaConf,
 		}
 
 		m.schemas[schemaConf.DB] = schema
@@ -114,7 +157,7 @@ func (m *HandlerElasticsearch) getSchema(db string) *models.Schema {
 
 func (m *HandlerElasticsearch) findEsNodes() error {
 
-	//m.nodes = make(map[string]*Node)
+	m.nodes = make(map[string]*models.BackendConfig)
 
 	for _, be := range m.conf.Backends {
 		if be.BackendType == "" {
@@ -127,19 +170,153 @@ func (m *HandlerElasticsearch) findEsNodes() error {
 			}
 		}
 		if be.BackendType == ListenerType {
-			// if _, ok := m.nodes[be.Name]; ok {
-			// 	return fmt.Errorf("duplicate node '%s'", be.Name)
-			// }
-
-			// n, err := m.startMysqlNode(be)
-			// if err != nil {
-			// 	return err
-			// }
+			if _, ok := m.nodes[be.Name]; ok {
+				return fmt.Errorf("duplicate node '%s'", be.Name)
+			}
+			if len(be.Master) == 0 {
+				return fmt.Errorf("must set master address for elasticsearch node '%s'", be.Name)
+			}
 
 			u.Infof("adding node: %s", be.String())
-			//m.nodes[be.Name] = n
+			m.nodes[be.Name] = be
 		}
 	}
 
 	return nil
 }
+
+func (m *HandlerElasticsearch) chooseCommand(writer models.ResultWriter, req *models.Request) error {
+
+	cmd := req.Raw[0]
+	req.Raw = req.Raw[1:]
+
+	u.Debugf("chooseCommand: %v:%v", cmd, mysql.CommandString(cmd))
+	switch cmd {
+	case mysql.COM_QUERY:
+		return m.handleQuery(writer, string(req.Raw))
+	case mysql.COM_PING:
+		return writer.WriteResult(&mysql.Result{})
+	case mysql.COM_INIT_DB:
+		if s := m.SchemaUse(string(req.Raw)); s == nil {
+			return mysql.NewDefaultError(mysql.ER_BAD_DB_ERROR, string(req.Raw))
+		}
+		return writer.WriteResult(&mysql.Result{})
+	case mysql.COM_FIELD_LIST:
+		return m.handleFieldList(writer, req.Raw)
+	case mysql.COM_QUIT:
+		return m.Close()
+	default:
+		msg := fmt.Sprintf("command %d:%s not supported for now", cmd, mysql.CommandString(cmd))
+		return mysql.NewError(mysql.ER_UNKNOWN_ERROR, msg)
+	}
+}
+
+func (m *HandlerElasticsearch) handleQuery(writer models.ResultWriter, sql string) error {
+
+	sql = strings.TrimRight(sql, ";")
+
+	if table, ok := sqlparser.DescribeTable(sql); ok {
+		return m.handleDescribe(writer, table)
+	}
+
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		u.Error(err)
+		return fmt.Errorf(`parse sql "%s" error`, sql)
+	}
+
+	u.Debugf("handleQuery: %T ", stmt)
+	switch v := stmt.(type) {
+	case *sqlparser.Select:
+		return m.handleSelect(writer, v)
+	case *sqlparser.Show:
+		return m.handleShow(writer, v)
+	default:
+		return fmt.Errorf("statement %T not support now for elasticsearch", stmt)
+	}
+}
+
+func (m *HandlerElasticsearch) handleSelect(writer models.ResultWriter, stmt *sqlparser.Select) error {
+
+	if m.schema == nil {
+		return mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
+	}
+
+	req, err := newSearchRequest(stmt)
+	if err != nil {
+		return err
+	}
+
+	resp := &searchResponse{}
+	if err := m.esRequest("POST", "/"+req.index+"/_search", req.Body(), resp); err != nil {
+		return err
+	}
+
+	r, err := req.resultset(resp)
+	if err != nil {
+		return err
+	}
+
+	return writer.WriteResult(&mysql.Result{Status: mysql.SERVER_STATUS_AUTOCOMMIT, Resultset: r})
+}
+
+// Find the address of the first node for the current schema,
+// in the order they were listed in config
+func (m *HandlerElasticsearch) nodeAddr() (string, error) {
+	if m.schema == nil || m.schema.Conf == nil {
+		return "", mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
+	}
+	for _, bename := range m.schema.Conf.Backends {
+		if be, ok := m.schema.Nodes[bename]; ok {
+			addr := be.Master
+			if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+				addr = "http://" + addr
+			}
+			return strings.TrimRight(addr, "/"), nil
+		}
+	}
+	return "", fmt.Errorf("no elasticsearch node found for schema '%s'", m.schema.Db)
+}
+
+// Make a json http request to elasticsearch, decoding the json
+// response into @out
+func (m *HandlerElasticsearch) esRequest(method, path string, body interface{}, out interface{}) error {
+
+	addr, err := m.nodeAddr()
+	if err != nil {
+		return err
+	}
+
+	var reqBody []byte
+	if body != nil {
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	u.Debugf("es request: %s %s%s  %s", method, addr, path, string(reqBody))
+
+	req, err := http.NewRequest(method, addr+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := EsClient.Do(req)
+	if err != nil {
+		u.Errorf("could not reach elasticsearch %s: %v", addr, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("elasticsearch error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(respBody))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
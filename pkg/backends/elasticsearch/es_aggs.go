@@ -0,0 +1,286 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/araddon/dataux/vendor/mixer/mysql"
+	"github.com/araddon/dataux/vendor/mixer/sqlparser"
+)
+
+/*
+Translate sql GROUP BY and aggregate functions into elasticsearch aggregations
+
+	select status, count(*), avg(latency) from logs group by status
+
+	{"size": 0, "aggs": {
+	  "g0": {"terms": {"field": "status", "size": 1000},
+	    "aggs": {"m2": {"avg": {"field": "latency"}}}}}}
+
+each group by column is a nested terms aggregation, the metrics are
+aggregations on the innermost buckets and count(*) is the bucket doc_count.
+The buckets are flattened into one row per innermost bucket.  A group by
+with more groups than the terms size is an error, not partial results.
+*/
+
+// the elasticsearch metric aggregation for each sql function
+var esAggFuncs = map[string]string{
+	"count": "value_count",
+	"sum":   "sum",
+	"avg":   "avg",
+	"min":   "min",
+	"max":   "max",
+}
+
+// An aggregate function in the select list
+type esAgg struct {
+	fn    string // sql function name
+	field string // field aggregated on, empty for count(*)
+	name  string // name of the es aggregation
+	esFn  string // es metric aggregation
+}
+
+func newEsAgg(fn *sqlparser.FuncExpr, pos int) (*esAgg, error) {
+
+	agg := &esAgg{fn: strings.ToLower(string(fn.Name)), name: fmt.Sprintf("m%d", pos)}
+	esFn, ok := esAggFuncs[agg.fn]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function for elasticsearch: %s", nstring(fn))
+	}
+	agg.esFn = esFn
+
+	if len(fn.Exprs) != 1 {
+		return nil, fmt.Errorf("%s requires one argument: %s", agg.fn, nstring(fn))
+	}
+	switch e := fn.Exprs[0].(type) {
+	case *sqlparser.StarExpr:
+		if agg.fn != "count" || fn.Distinct {
+			return nil, fmt.Errorf("unsupported function for elasticsearch: %s", nstring(fn))
+		}
+		return agg, nil
+	case *sqlparser.NonStarExpr:
+		col, ok := e.Expr.(*sqlparser.ColName)
+		if !ok {
+			return nil, fmt.Errorf("elasticsearch aggregates require a field: %s", nstring(fn))
+		}
+		agg.field = string(col.Name)
+	}
+
+	if fn.Distinct {
+		if agg.fn != "count" {
+			return nil, fmt.Errorf("unsupported function for elasticsearch: %s", nstring(fn))
+		}
+		// approximate, but it is what es has
+		agg.esFn = "cardinality"
+	}
+	return agg, nil
+}
+
+// Set the mysql field type, counts are integers the rest are doubles
+func (m *esAgg) formatField(field *mysql.Field) {
+	field.Charset = 63
+	field.Flag = mysql.BINARY_FLAG
+	if m.fn == "count" {
+		field.Type = mysql.MYSQL_TYPE_LONGLONG
+	} else {
+		field.Type = mysql.MYSQL_TYPE_DOUBLE
+	}
+}
+
+// The value of this aggregate from a bucket
+func (m *esAgg) value(bucket map[string]interface{}) interface{} {
+	if m.field == "" {
+		return bucket["doc_count"]
+	}
+	if metric, ok := bucket[m.name].(map[string]interface{}); ok {
+		return metric["value"]
+	}
+	return nil
+}
+
+// Validate the group by against the select columns, every plain
+// column must be grouped on
+func (m *searchRequest) parseGroupBy() error {
+
+	if m.stmt.Having != nil {
+		return fmt.Errorf("having not supported for elasticsearch: %s", nstring(m.stmt.Having))
+	}
+	if m.cols == nil {
+		return fmt.Errorf("cannot select * with group by: %s", nstring(m.stmt.GroupBy))
+	}
+
+	for _, expr := range m.stmt.GroupBy {
+		field := sqlparser.GetColName(expr)
+		if field == "" {
+			return fmt.Errorf("unsupported group by %s", nstring(expr))
+		}
+		m.groupBy = append(m.groupBy, field)
+	}
+	m.aggs = true
+
+cols:
+	for i, c := range m.cols {
+		if c.agg != nil {
+			continue
+		}
+		for j, field := range m.groupBy {
+			if field == c.field {
+				m.cols[i].group = j
+				continue cols
+			}
+		}
+		return fmt.Errorf("column %s must be in group by for elasticsearch", c.expr)
+	}
+
+	// validate order by now, it is applied to the flattened rows
+	for _, o := range m.stmt.OrderBy {
+		if _, err := m.sortKey(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the result column to sort on for an order by of an aggregate query
+func (m *searchRequest) sortKey(o *sqlparser.Order) (mysql.SortKey, error) {
+	expr := nstring(o.Expr)
+	for _, c := range m.cols {
+		if c.name == expr || c.expr == expr {
+			return mysql.SortKey{Name: c.name, Direction: o.Direction}, nil
+		}
+	}
+	return mysql.SortKey{}, fmt.Errorf("order by %s must be a selected column", expr)
+}
+
+// The es aggregations request body, nested terms aggs for each
+// group by field with the metrics on the innermost
+func (m *searchRequest) aggsBody() map[string]interface{} {
+
+	aggs := make(map[string]interface{})
+	for _, c := range m.cols {
+		if c.agg != nil && c.agg.field != "" {
+			aggs[c.agg.name] = map[string]interface{}{
+				c.agg.esFn: map[string]interface{}{"field": c.agg.field},
+			}
+		}
+	}
+
+	for i := len(m.groupBy) - 1; i >= 0; i-- {
+		terms := map[string]interface{}{
+			"terms": map[string]interface{}{"field": m.groupBy[i], "size": MaxScanSize},
+		}
+		if len(aggs) > 0 {
+			terms["aggs"] = aggs
+		}
+		aggs = map[string]interface{}{fmt.Sprintf("g%d", i): terms}
+	}
+
+	return aggs
+}
+
+// Flatten the es aggregation buckets into a mysql resultset
+func (m *searchRequest) aggResultset(resp *searchResponse) (*mysql.Resultset, error) {
+
+	var rows [][]interface{}
+	if len(m.groupBy) == 0 {
+		// no group by, the whole result is one bucket
+		top := map[string]interface{}{"doc_count": resp.Hits.Total}
+		for k, v := range resp.Aggregations {
+			top[k] = v
+		}
+		rows = append(rows, m.aggRow(top, nil))
+	} else {
+		var err error
+		if rows, err = m.aggBuckets(resp.Aggregations, 0, nil, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	r := newResultset(m.index, m.cols, rows)
+
+	if len(m.stmt.OrderBy) > 0 {
+		sk := make([]mysql.SortKey, len(m.stmt.OrderBy))
+		for i, o := range m.stmt.OrderBy {
+			k, err := m.sortKey(o)
+			if err != nil {
+				return nil, err
+			}
+			sk[i] = k
+		}
+		if err := r.Sort(sk); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.limit >= 0 {
+		start, end := m.offset, m.offset+m.limit
+		if start > len(r.Values) {
+			start = len(r.Values)
+		}
+		if end > len(r.Values) {
+			end = len(r.Values)
+		}
+		r.Values = r.Values[start:end]
+		r.RowDatas = r.RowDatas[start:end]
+	}
+
+	return r, nil
+}
+
+// Walk the nested terms buckets for group by @depth, appending a
+// row for each innermost bucket
+func (m *searchRequest) aggBuckets(aggs map[string]interface{}, depth int, keys []interface{},
+	rows [][]interface{}) ([][]interface{}, error) {
+
+	name := fmt.Sprintf("g%d", depth)
+	terms, ok := aggs[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("missing aggregation %s in elasticsearch response", name)
+	}
+	// docs in groups past the terms size
+	if other, _ := terms["sum_other_doc_count"].(json.Number); other != "" && other != "0" {
+		return nil, fmt.Errorf("group by %s has more than %d groups", m.groupBy[depth], MaxScanSize)
+	}
+	buckets, _ := terms["buckets"].([]interface{})
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid bucket in elasticsearch response: %v", b)
+		}
+		bkeys := append(keys[:len(keys):len(keys)], bucketKey(bucket))
+		if depth+1 < len(m.groupBy) {
+			var err error
+			if rows, err = m.aggBuckets(bucket, depth+1, bkeys, rows); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rows = append(rows, m.aggRow(bucket, bkeys))
+	}
+	return rows, nil
+}
+
+func (m *searchRequest) aggRow(bucket map[string]interface{}, keys []interface{}) []interface{} {
+	row := make([]interface{}, len(m.cols))
+	for i, c := range m.cols {
+		if c.agg != nil {
+			row[i] = c.agg.value(bucket)
+		} else {
+			row[i] = keys[c.group]
+		}
+	}
+	return row
+}
+
+// The group by value of a bucket, es returns booleans and dates as
+// numeric keys with a formatted key_as_string
+func bucketKey(bucket map[string]interface{}) interface{} {
+	if s, ok := bucket["key_as_string"].(string); ok {
+		if s == "true" || s == "false" {
+			return s == "true"
+		}
+		return s
+	}
+	return bucket["key"]
+}
@@ -0,0 +1,319 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/araddon/dataux/pkg/models"
+	"github.com/araddon/dataux/vendor/mixer/hack"
+	"github.com/araddon/dataux/vendor/mixer/mysql"
+	"github.com/araddon/dataux/vendor/mixer/sqlparser"
+)
+
+/*
+Schema info for elasticsearch, the indexes and aliases are the
+tables and the fields of the index _mapping are the columns.
+
+	show tables [from db] [like 'pattern']
+	describe index | desc index | show [full] columns from index
+	COM_FIELD_LIST
+*/
+
+// The mysql type for an elasticsearch mapping type
+type esFieldType struct {
+	sqlType   string // type as shown by describe
+	fieldType uint8  // mysql protocol field type
+	length    uint32 // column length
+}
+
+var (
+	esTypes = map[string]esFieldType{
+		"string":       {"varchar(255)", mysql.MYSQL_TYPE_VAR_STRING, 255 * 3},
+		"keyword":      {"varchar(255)", mysql.MYSQL_TYPE_VAR_STRING, 255 * 3},
+		"text":         {"text", mysql.MYSQL_TYPE_BLOB, 65535},
+		"long":         {"bigint(20)", mysql.MYSQL_TYPE_LONGLONG, 20},
+		"integer":      {"int(11)", mysql.MYSQL_TYPE_LONG, 11},
+		"short":        {"smallint(6)", mysql.MYSQL_TYPE_SHORT, 6},
+		"byte":         {"tinyint(4)", mysql.MYSQL_TYPE_TINY, 4},
+		"double":       {"double", mysql.MYSQL_TYPE_DOUBLE, 22},
+		"float":        {"float", mysql.MYSQL_TYPE_FLOAT, 12},
+		"half_float":   {"float", mysql.MYSQL_TYPE_FLOAT, 12},
+		"scaled_float": {"float", mysql.MYSQL_TYPE_FLOAT, 12},
+		"boolean":      {"tinyint(1)", mysql.MYSQL_TYPE_TINY, 1},
+		"date":         {"datetime", mysql.MYSQL_TYPE_DATETIME, 19},
+		"ip":           {"varchar(45)", mysql.MYSQL_TYPE_VAR_STRING, 45 * 3},
+		"binary":       {"blob", mysql.MYSQL_TYPE_BLOB, 65535},
+	}
+	// geo_point, nested etc get returned as json text
+	esDefaultType = esFieldType{"text", mysql.MYSQL_TYPE_BLOB, 65535}
+)
+
+func esTypeToMysql(esType string) esFieldType {
+	if t, ok := esTypes[esType]; ok {
+		return t
+	}
+	return esDefaultType
+}
+
+// A field from an index mapping, nested object fields are
+// flattened into dotted names
+type esMappingField struct {
+	name   string
+	esType string
+}
+
+func (m *HandlerElasticsearch) handleShow(writer models.ResultWriter, stmt *sqlparser.Show) error {
+
+	var r *mysql.Resultset
+	var err error
+	switch strings.ToLower(stmt.Section) {
+	case "databases":
+		r = m.showDatabases()
+	case "tables":
+		r, err = m.showTables(stmt)
+	default:
+		err = fmt.Errorf("unsupport show %s for elasticsearch", stmt.Section)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writer.WriteResult(&mysql.Result{Status: mysql.SERVER_STATUS_AUTOCOMMIT, Resultset: r})
+}
+
+func (m *HandlerElasticsearch) showDatabases() *mysql.Resultset {
+	dbs := make([]string, 0, len(m.schemas))
+	for db := range m.schemas {
+		if m.canUse(db) {
+			dbs = append(dbs, db)
+		}
+	}
+	sort.Strings(dbs)
+	return stringResultset("", "Database", dbs)
+}
+
+// True if the user of the connection may use schema @db
+func (m *HandlerElasticsearch) canUse(db string) bool {
+	return m.grants == nil || m.grants.CanUseSchema(db)
+}
+
+func (m *HandlerElasticsearch) showTables(stmt *sqlparser.Show) (*mysql.Resultset, error) {
+
+	h := m
+	if stmt.From != nil {
+		db := nstring(stmt.From)
+		if !m.canUse(db) {
+			return nil, mysql.NewDefaultError(mysql.ER_BAD_DB_ERROR, db)
+		}
+		if m.schema == nil || m.schema.Db != db {
+			h = m.Clone(nil).(*HandlerElasticsearch)
+			if h.SchemaUse(db) == nil {
+				return nil, mysql.NewDefaultError(mysql.ER_BAD_DB_ERROR, db)
+			}
+		}
+	}
+	if h.schema == nil {
+		return nil, mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
+	}
+
+	pattern := ""
+	if stmt.LikeOrWhere != nil {
+		like, ok := stmt.LikeOrWhere.(sqlparser.StrVal)
+		if !ok {
+			return nil, fmt.Errorf("unsupported show tables filter for elasticsearch: %s", nstring(stmt.LikeOrWhere))
+		}
+		pattern = likeToWildcard(string(like))
+	}
+
+	tables, err := h.tableNames()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(tables))
+	for _, table := range tables {
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, table); !ok {
+				continue
+			}
+		}
+		names = append(names, table)
+	}
+
+	return stringResultset("", "Tables_in_"+h.schema.Db, names), nil
+}
+
+// The tables for elasticsearch are all of the indexes and aliases,
+// leaving out the hidden .indexes
+func (m *HandlerElasticsearch) tableNames() ([]string, error) {
+
+	resp := make(map[string]struct {
+		Aliases map[string]interface{} `json:"aliases"`
+	})
+	if err := m.esRequest("GET", "/_aliases", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	for index, info := range resp {
+		seen[index] = struct{}{}
+		for alias := range info.Aliases {
+			seen[alias] = struct{}{}
+		}
+	}
+
+	tables := make([]string, 0, len(seen))
+	for table := range seen {
+		if !strings.HasPrefix(table, ".") {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// The fields for an index or alias, merged across all of the indexes
+// and types in the mapping and sorted by name
+func (m *HandlerElasticsearch) indexFields(index string) ([]esMappingField, error) {
+
+	if m.schema == nil {
+		return nil, mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
+	}
+
+	resp := make(map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	})
+	if err := m.esRequest("GET", "/"+index+"/_mapping", nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return nil, mysql.NewDefaultError(mysql.ER_NO_SUCH_TABLE, m.schema.Db, index)
+	}
+
+	types := make(map[string]string)
+	for _, idx := range resp {
+		if props, ok := idx.Mappings["properties"].(map[string]interface{}); ok {
+			// typeless mappings of newer es versions
+			mappingFields("", props, types)
+			continue
+		}
+		for _, mapping := range idx.Mappings {
+			if tm, ok := mapping.(map[string]interface{}); ok {
+				if props, ok := tm["properties"].(map[string]interface{}); ok {
+					mappingFields("", props, types)
+				}
+			}
+		}
+	}
+
+	fields := make([]esMappingField, 0, len(types))
+	for name, esType := range types {
+		fields = append(fields, esMappingField{name: name, esType: esType})
+	}
+	sort.Sort(fieldsByName(fields))
+	return fields, nil
+}
+
+// Flatten the mapping properties, object fields become dotted names
+func mappingFields(prefix string, props map[string]interface{}, types map[string]string) {
+	for name, p := range props {
+		prop, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		esType, _ := prop["type"].(string)
+		if sub, ok := prop["properties"].(map[string]interface{}); ok && (esType == "" || esType == "object") {
+			mappingFields(prefix+name+".", sub, types)
+			continue
+		}
+		if esType == "" {
+			esType = "object"
+		}
+		types[prefix+name] = esType
+	}
+}
+
+type fieldsByName []esMappingField
+
+func (f fieldsByName) Len() int           { return len(f) }
+func (f fieldsByName) Less(i, j int) bool { return f[i].name < f[j].name }
+func (f fieldsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func (m *HandlerElasticsearch) handleDescribe(writer models.ResultWriter, table string) error {
+
+	fields, err := m.indexFields(table)
+	if err != nil {
+		return err
+	}
+
+	cols := []esColumn{{name: "Field"}, {name: "Type"}, {name: "Null"}, {name: "Key"}, {name: "Default"}, {name: "Extra"}}
+	rows := make([][]interface{}, len(fields))
+	for i, f := range fields {
+		rows[i] = []interface{}{f.name, esTypeToMysql(f.esType).sqlType, "YES", "", nil, ""}
+	}
+
+	r := newResultset("", cols, rows)
+	return writer.WriteResult(&mysql.Result{Status: mysql.SERVER_STATUS_AUTOCOMMIT, Resultset: r})
+}
+
+func (m *HandlerElasticsearch) handleFieldList(writer models.ResultWriter, data []byte) error {
+
+	table := string(data)
+	wildcard := ""
+	if i := strings.IndexByte(table, 0x00); i >= 0 {
+		table, wildcard = table[:i], strings.TrimRight(table[i+1:], "\x00")
+	}
+
+	fields, err := m.indexFields(table)
+	if err != nil {
+		return err
+	}
+
+	fs := make([]*mysql.Field, 0, len(fields))
+	for _, f := range fields {
+		if wildcard != "" {
+			if ok, _ := path.Match(likeToWildcard(wildcard), f.name); !ok {
+				continue
+			}
+		}
+		fs = append(fs, mappingField(m.schema.Db, table, f))
+	}
+
+	return writer.WriteResult(fs)
+}
+
+// The mysql field definition for an es mapping field
+func mappingField(db, table string, f esMappingField) *mysql.Field {
+	t := esTypeToMysql(f.esType)
+	field := &mysql.Field{
+		Schema:       hack.Slice(db),
+		Table:        hack.Slice(table),
+		OrgTable:     hack.Slice(table),
+		Name:         hack.Slice(f.name),
+		OrgName:      hack.Slice(f.name),
+		ColumnLength: t.length,
+		Type:         t.fieldType,
+	}
+	switch t.fieldType {
+	case mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_BLOB:
+		field.Charset = 33
+	default:
+		field.Charset = 63
+		field.Flag = mysql.BINARY_FLAG
+	}
+	if f.esType == "binary" {
+		field.Charset = 63
+		field.Flag = mysql.BINARY_FLAG | mysql.BLOB_FLAG
+	}
+	return field
+}
+
+func stringResultset(table, name string, values []string) *mysql.Resultset {
+	rows := make([][]interface{}, len(values))
+	for i, v := range values {
+		rows[i] = []interface{}{v}
+	}
+	return newResultset(table, []esColumn{{name: name}}, rows)
+}
@@ -0,0 +1,372 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/araddon/dataux/vendor/mixer/hack"
+	"github.com/araddon/dataux/vendor/mixer/mysql"
+	"github.com/araddon/dataux/vendor/mixer/sqlparser"
+	u "github.com/araddon/gou"
+)
+
+var (
+	_ = u.EMPTY
+
+	// Max number of documents we will pull back from elasticsearch
+	// for a single query when it has no LIMIT
+	MaxScanSize = 1000
+)
+
+// Column requested in sql select, mapping a document field to
+// a result column name
+type esColumn struct {
+	field string // document field in _source
+	name  string // result column name (alias)
+	expr  string // the select expression as written
+	agg   *esAgg // aggregate function, nil for plain fields
+	group int    // index into group by for plain fields of an aggregate query
+}
+
+// searchRequest is a SQL Select statement translated into an
+// elasticsearch search request
+type searchRequest struct {
+	stmt    *sqlparser.Select
+	index   string
+	cols    []esColumn // nil for select *
+	groupBy []string   // group by fields, turned into nested terms aggs
+	aggs    bool       // is this an aggregate query
+	sort    []interface{}
+	query   map[string]interface{} // es query translated from where
+	offset  int
+	limit   int // -1 for no limit
+}
+
+type searchResponse struct {
+	Took         int                    `json:"took"`
+	TimedOut     bool                   `json:"timed_out"`
+	Hits         searchHits             `json:"hits"`
+	Aggregations map[string]interface{} `json:"aggregations"`
+}
+
+type searchHits struct {
+	Total json.Number `json:"total"`
+	Hits  []searchHit `json:"hits"`
+}
+
+type searchHit struct {
+	Index  string                 `json:"_index"`
+	Type   string                 `json:"_type"`
+	Id     string                 `json:"_id"`
+	Source map[string]interface{} `json:"_source"`
+}
+
+func newSearchRequest(stmt *sqlparser.Select) (*searchRequest, error) {
+
+	req := &searchRequest{stmt: stmt, limit: -1}
+
+	if len(stmt.From) != 1 {
+		return nil, fmt.Errorf("elasticsearch only supports select from a single index: %s", nstring(stmt.From))
+	}
+	ate, ok := stmt.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return nil, fmt.Errorf("elasticsearch does not support joins: %s", nstring(stmt.From))
+	}
+	req.index = sqlparser.GetTableName(ate.Expr)
+	if req.index == "" {
+		return nil, fmt.Errorf("invalid index name %s", nstring(ate.Expr))
+	}
+
+	for _, expr := range stmt.SelectExprs {
+		switch e := expr.(type) {
+		case *sqlparser.StarExpr:
+			if len(stmt.SelectExprs) != 1 {
+				return nil, fmt.Errorf("cannot mix * with other columns: %s", nstring(stmt.SelectExprs))
+			}
+			req.cols = nil
+		case *sqlparser.NonStarExpr:
+			var c esColumn
+			switch ve := e.Expr.(type) {
+			case *sqlparser.ColName:
+				c = esColumn{field: string(ve.Name)}
+			case *sqlparser.FuncExpr:
+				agg, err := newEsAgg(ve, len(req.cols))
+				if err != nil {
+					return nil, err
+				}
+				c = esColumn{field: agg.field, agg: agg}
+				req.aggs = true
+			default:
+				return nil, fmt.Errorf("unsupported select expression %s", nstring(e))
+			}
+			c.expr = nstring(e.Expr)
+			c.name = c.expr
+			if e.As != nil {
+				c.name = string(e.As)
+			}
+			req.cols = append(req.cols, c)
+		}
+	}
+
+	if len(stmt.GroupBy) > 0 || req.aggs {
+		if err := req.parseGroupBy(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, o := range stmt.OrderBy {
+			field := sqlparser.GetColName(o.Expr)
+			if field == "" {
+				return nil, fmt.Errorf("unsupported order by %s", nstring(o))
+			}
+			req.sort = append(req.sort, map[string]interface{}{
+				field: map[string]string{"order": o.Direction},
+			})
+		}
+	}
+
+	if stmt.Where != nil {
+		q, err := whereQuery(stmt.Where.Expr)
+		if err != nil {
+			return nil, err
+		}
+		req.query = map[string]interface{}{
+			"bool": map[string]interface{}{"filter": q},
+		}
+	}
+
+	if stmt.Limit != nil {
+		var err error
+		if stmt.Limit.Offset != nil {
+			if req.offset, err = limitValue(stmt.Limit.Offset); err != nil {
+				return nil, err
+			}
+		}
+		if req.limit, err = limitValue(stmt.Limit.Rowcount); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+func limitValue(val sqlparser.ValExpr) (int, error) {
+	nv, ok := val.(sqlparser.NumVal)
+	if !ok {
+		return 0, fmt.Errorf("invalid limit %s", nstring(val))
+	}
+	n, err := strconv.Atoi(string(nv))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid limit %s", nstring(val))
+	}
+	return n, nil
+}
+
+// Body is the json search request body to send to elasticsearch
+func (m *searchRequest) Body() map[string]interface{} {
+
+	body := map[string]interface{}{
+		"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+	}
+	if m.query != nil {
+		body["query"] = m.query
+	}
+
+	if m.aggs {
+		// we only want the buckets, limit and order are applied
+		// to the flattened rows
+		body["size"] = 0
+		if aggs := m.aggsBody(); len(aggs) > 0 {
+			body["aggs"] = aggs
+		}
+		return body
+	}
+
+	if m.limit >= 0 {
+		body["from"] = m.offset
+		body["size"] = m.limit
+	} else {
+		body["size"] = MaxScanSize
+	}
+
+	if len(m.sort) > 0 {
+		body["sort"] = m.sort
+	}
+	if len(m.cols) > 0 {
+		fields := make([]string, len(m.cols))
+		for i, c := range m.cols {
+			fields[i] = c.field
+		}
+		body["_source"] = fields
+	}
+
+	return body
+}
+
+// Convert the elasticsearch search hits into a mysql resultset
+func (m *searchRequest) resultset(resp *searchResponse) (*mysql.Resultset, error) {
+
+	if m.aggs {
+		return m.aggResultset(resp)
+	}
+
+	docs := make([]map[string]interface{}, 0, len(resp.Hits.Hits))
+	for _, hit := range resp.Hits.Hits {
+		docs = append(docs, hit.Source)
+	}
+
+	cols := m.cols
+	if cols == nil {
+		// select *, the columns are the union of all document fields
+		seen := make(map[string]struct{})
+		for _, doc := range docs {
+			for field := range doc {
+				if _, ok := seen[field]; !ok {
+					seen[field] = struct{}{}
+					cols = append(cols, esColumn{field: field, name: field})
+				}
+			}
+		}
+		sort.Sort(columnsByName(cols))
+	}
+
+	rows := make([][]interface{}, len(docs))
+	for i, doc := range docs {
+		rows[i] = make([]interface{}, len(cols))
+		for j, c := range cols {
+			rows[i][j] = docValue(doc, c.field)
+		}
+	}
+
+	return newResultset(m.index, cols, rows), nil
+}
+
+// Build a mysql resultset from rows of json values
+func newResultset(table string, cols []esColumn, rows [][]interface{}) *mysql.Resultset {
+
+	r := new(mysql.Resultset)
+	r.Fields = make([]*mysql.Field, len(cols))
+	r.FieldNames = make(map[string]int, len(cols))
+	for i, c := range cols {
+		r.Fields[i] = &mysql.Field{Name: hack.Slice(c.name), OrgName: hack.Slice(c.field), Table: hack.Slice(table)}
+		if c.agg != nil {
+			c.agg.formatField(r.Fields[i])
+		}
+		r.FieldNames[c.name] = i
+	}
+
+	for _, rowVals := range rows {
+		vals := make([]interface{}, len(cols))
+		var row []byte
+		for i, v := range rowVals {
+			formatField(r.Fields[i], v)
+			if v == nil {
+				row = append(row, 0xfb)
+				continue
+			}
+			b := formatValue(v)
+			vals[i] = rowValue(r.Fields[i], b)
+			row = append(row, mysql.PutLengthEncodedString(b)...)
+		}
+		r.Values = append(r.Values, vals)
+		r.RowDatas = append(r.RowDatas, row)
+	}
+
+	for _, f := range r.Fields {
+		if f.Type == 0 {
+			// no values seen for this column
+			formatField(f, "")
+		}
+	}
+
+	return r
+}
+
+type columnsByName []esColumn
+
+func (c columnsByName) Len() int           { return len(c) }
+func (c columnsByName) Less(i, j int) bool { return c[i].name < c[j].name }
+func (c columnsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Find a value in a document, field may be a dotted path
+// into nested objects
+func docValue(doc map[string]interface{}, field string) interface{} {
+	if v, ok := doc[field]; ok {
+		return v
+	}
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) == 2 {
+		if sub, ok := doc[parts[0]].(map[string]interface{}); ok {
+			return docValue(sub, parts[1])
+		}
+	}
+	return nil
+}
+
+// Set the mysql field type from a json value, the first
+// non-null value for a column wins
+func formatField(field *mysql.Field, value interface{}) {
+	if field.Type != 0 || value == nil {
+		return
+	}
+	switch v := value.(type) {
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			field.Charset = 63
+			field.Type = mysql.MYSQL_TYPE_LONGLONG
+			field.Flag = mysql.BINARY_FLAG
+		} else {
+			field.Charset = 63
+			field.Type = mysql.MYSQL_TYPE_DOUBLE
+			field.Flag = mysql.BINARY_FLAG
+		}
+	case bool:
+		field.Charset = 63
+		field.Type = mysql.MYSQL_TYPE_TINY
+		field.Flag = mysql.BINARY_FLAG
+	default:
+		field.Charset = 33
+		field.Type = mysql.MYSQL_TYPE_VAR_STRING
+	}
+}
+
+// Format a json value as mysql text protocol value
+func formatValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case json.Number:
+		return []byte(v.String())
+	case string:
+		return hack.Slice(v)
+	case bool:
+		if v {
+			return []byte("1")
+		}
+		return []byte("0")
+	default:
+		// nested objects and arrays get returned as json
+		by, err := json.Marshal(v)
+		if err != nil {
+			return []byte(fmt.Sprintf("%v", v))
+		}
+		return by
+	}
+}
+
+// The value as it would be parsed from a mysql text row
+func rowValue(field *mysql.Field, b []byte) interface{} {
+	switch field.Type {
+	case mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_TINY:
+		if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			return n
+		}
+	case mysql.MYSQL_TYPE_DOUBLE:
+		if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return f
+		}
+	}
+	return b
+}
+
+var nstring = sqlparser.String
@@ -1 +1,394 @@
 package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/araddon/dataux/pkg/models"
+	"github.com/araddon/dataux/vendor/mixer/mysql"
+	"github.com/araddon/dataux/vendor/mixer/sqlparser"
+	u "github.com/araddon/gou"
+	"github.com/bmizerany/assert"
+)
+
+var _ = u.EMPTY
+
+var testHits = `{
+  "took": 2, "timed_out": false,
+  "hits": {
+    "total": 3,
+    "hits": [
+      {"_index":"logs","_type":"log","_id":"1","_source":{"status":200,"latency":1.5,"path":"/a","user":{"name":"bob"}}},
+      {"_index":"logs","_type":"log","_id":"2","_source":{"status":404,"latency":0.5,"path":"/b"}},
+      {"_index":"logs","_type":"log","_id":"3","_source":{"status":200,"latency":3.25,"path":"/c"}}
+    ]
+  }
+}`
+
+type testResultWriter struct {
+	results []*mysql.Result
+	fields  [][]*mysql.Field
+}
+
+func (m *testResultWriter) WriteResult(r models.Result) error {
+	switch res := r.(type) {
+	case []*mysql.Field:
+		m.fields = append(m.fields, res)
+	default:
+		m.results = append(m.results, res.(*mysql.Result))
+	}
+	return nil
+}
+
+// a fake elasticsearch, returns @resp for any search and captures
+// the request bodies
+func newTestEs(t *testing.T, resp string, bodies *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		by, _ := ioutil.ReadAll(r.Body)
+		body := make(map[string]interface{})
+		if len(by) > 0 {
+			assert.Tf(t, json.Unmarshal(by, &body) == nil, "must send json body %s", string(by))
+		}
+		if bodies != nil {
+			*bodies = append(*bodies, body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, resp)
+	}))
+}
+
+func newTestHandler(t *testing.T, addr string) *HandlerElasticsearch {
+	conf, err := models.LoadConfig(fmt.Sprintf(`
+backends [
+  {
+    name : es1
+    backend_type : elasticsearch
+    master : "%s"
+  }
+]
+schemas : [
+  {
+    db : logs
+    backends : ["es1"]
+    backend_type : elasticsearch
+  }
+]
+`, addr))
+	assert.Tf(t, err == nil, "must load config: %v", err)
+
+	handler, err := NewHandlerElasticsearch(conf)
+	assert.Tf(t, err == nil, "must create handler: %v", err)
+	h := handler.(*HandlerElasticsearch).Clone(nil).(*HandlerElasticsearch)
+	assert.Tf(t, h.SchemaUse("logs") != nil, "must find schema")
+	return h
+}
+
+func runQuery(t *testing.T, h *HandlerElasticsearch, sql string) *mysql.Result {
+	w := &testResultWriter{}
+	err := h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, sql...)})
+	assert.Tf(t, err == nil, "must not error on %s: %v", sql, err)
+	assert.Tf(t, len(w.results) == 1, "must write one result: %v", len(w.results))
+	return w.results[0]
+}
+
+func TestEsSelect(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := newTestEs(t, testHits, &bodies)
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+
+	r := runQuery(t, h, "select path, status from logs limit 2")
+	assert.Tf(t, len(r.Fields) == 2, "must have 2 fields: %v", len(r.Fields))
+	assert.Tf(t, string(r.Fields[0].Name) == "path", "first field path: %s", r.Fields[0].Name)
+	assert.Tf(t, r.Fields[1].Type == mysql.MYSQL_TYPE_LONGLONG, "status is int: %v", r.Fields[1].Type)
+	// the limit is sent to es, our fake ignores it
+	assert.Tf(t, r.RowNumber() == 3, "must have 3 rows: %v", r.RowNumber())
+	assert.Tf(t, bodies[0]["size"] == float64(2), "must send size: %v", bodies[0])
+	path, _ := r.GetString(0, 0)
+	assert.Tf(t, path == "/a", "path: %v", path)
+
+	r = runQuery(t, h, "select * from logs")
+	assert.Tf(t, len(r.Fields) == 4, "must have all fields: %v", len(r.Fields))
+	idx, err := r.NameIndex("latency")
+	assert.Tf(t, err == nil && r.Fields[idx].Type == mysql.MYSQL_TYPE_DOUBLE, "latency is double")
+	idx, _ = r.NameIndex("user")
+	user, _ := r.GetString(0, idx)
+	assert.Tf(t, strings.Contains(user, "bob"), "nested objects as json: %v", user)
+	isNull, _ := r.IsNull(1, idx)
+	assert.T(t, isNull, "missing fields are null")
+}
+
+func TestEsSelectWhere(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := newTestEs(t, testHits, &bodies)
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+
+	runQuery(t, h, "select path from logs where status = 200 and latency > 2 limit 5")
+	by, _ := json.Marshal(bodies[0]["query"])
+	assert.Tf(t, string(by) == `{"bool":{"filter":{"bool":{"must":[{"term":{"status":200}},{"range":{"latency":{"gt":2}}}]}}}}`,
+		"must push where to es: %s", string(by))
+	assert.Tf(t, bodies[0]["size"] == float64(5), "must send size: %v", bodies[0])
+}
+
+func TestEsWhereQuery(t *testing.T) {
+	tests := []struct {
+		where string
+		query string
+	}{
+		{"a = 'x'", `{"term":{"a":"x"}}`},
+		{"a != 1", `{"bool":{"must_not":{"term":{"a":1}}}}`},
+		{"5 < a", `{"range":{"a":{"gt":5}}}`},
+		{"a <= 1.5", `{"range":{"a":{"lte":1.5}}}`},
+		{"a between 1 and 5", `{"range":{"a":{"gte":1,"lte":5}}}`},
+		{"a not between 1 and 5", `{"bool":{"must_not":{"range":{"a":{"gte":1,"lte":5}}}}}`},
+		{"a in (1, 2)", `{"terms":{"a":[1,2]}}`},
+		{"a not in ('x')", `{"bool":{"must_not":{"terms":{"a":["x"]}}}}`},
+		{"a like 'b%_'", `{"wildcard":{"a":"b*?"}}`},
+		{"a is null", `{"bool":{"must_not":{"exists":{"field":"a"}}}}`},
+		{"a is not null", `{"exists":{"field":"a"}}`},
+		{"a = 1 or (b = 2 and not c = 3)", `{"bool":{"minimum_should_match":1,"should":[{"term":{"a":1}},` +
+			`{"bool":{"must":[{"term":{"b":2}},{"bool":{"must_not":{"term":{"c":3}}}}]}}]}}`},
+	}
+	for _, tt := range tests {
+		stmt, err := sqlparser.Parse("select * from t where " + tt.where)
+		assert.Tf(t, err == nil, "must parse %s: %v", tt.where, err)
+		q, err := whereQuery(stmt.(*sqlparser.Select).Where.Expr)
+		assert.Tf(t, err == nil, "must translate %s: %v", tt.where, err)
+		by, _ := json.Marshal(q)
+		assert.Tf(t, string(by) == tt.query, "%s\n  got  %s\n  want %s", tt.where, string(by), tt.query)
+	}
+
+	for _, where := range []string{"a = b", "a + 1 = 2", "exists (select 1 from b)"} {
+		stmt, err := sqlparser.Parse("select * from t where " + where)
+		assert.Tf(t, err == nil, "must parse %s: %v", where, err)
+		_, err = whereQuery(stmt.(*sqlparser.Select).Where.Expr)
+		assert.Tf(t, err != nil, "must not translate %s", where)
+	}
+}
+
+func TestEsErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, `{"error":"IndexMissingException[[nope] missing]","status":404}`)
+	}))
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+	w := &testResultWriter{}
+	err := h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, "select * from nope"...)})
+	assert.T(t, err != nil, "must return es error")
+
+	err = h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, "update nope set a = 1"...)})
+	assert.T(t, err != nil, "updates not supported")
+}
+
+var testAggs = `{
+  "took": 3, "timed_out": false,
+  "hits": {"total": 6, "hits": []},
+  "aggregations": {
+    "g0": {"buckets": [
+      {"key": "GET", "doc_count": 4, "g1": {"buckets": [
+        {"key": 200, "doc_count": 3, "m3": {"value": 1.5}},
+        {"key": 404, "doc_count": 1, "m3": {"value": 0.5}}
+      ]}},
+      {"key": "POST", "doc_count": 2, "g1": {"buckets": [
+        {"key": 200, "doc_count": 2, "m3": {"value": 9}}
+      ]}}
+    ]}
+  }
+}`
+
+func TestEsGroupBy(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := newTestEs(t, testAggs, &bodies)
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+
+	r := runQuery(t, h, "select method, status, count(*) as ct, avg(latency) from logs "+
+		"where path = '/a' group by method, status order by ct desc limit 2")
+
+	by, _ := json.Marshal(bodies[0]["aggs"])
+	assert.Tf(t, string(by) == `{"g0":{"aggs":{"g1":{"aggs":{"m3":{"avg":{"field":"latency"}}},`+
+		`"terms":{"field":"status","size":1000}}},"terms":{"field":"method","size":1000}}}`,
+		"must send nested terms aggs: %s", string(by))
+	assert.Tf(t, bodies[0]["size"] == float64(0), "must not fetch hits: %v", bodies[0])
+	assert.Tf(t, bodies[0]["query"] != nil, "must still filter: %v", bodies[0])
+
+	assert.Tf(t, len(r.Fields) == 4, "must have 4 fields: %v", len(r.Fields))
+	assert.Tf(t, r.Fields[1].Type == mysql.MYSQL_TYPE_LONGLONG, "status is int: %v", r.Fields[1].Type)
+	assert.Tf(t, r.Fields[2].Type == mysql.MYSQL_TYPE_LONGLONG, "count is int: %v", r.Fields[2].Type)
+	assert.Tf(t, r.Fields[3].Type == mysql.MYSQL_TYPE_DOUBLE, "avg is double: %v", r.Fields[3].Type)
+	assert.Tf(t, r.RowNumber() == 2, "limit applied to buckets: %v", r.RowNumber())
+
+	method, _ := r.GetString(0, 0)
+	ct, _ := r.GetInt(0, 2)
+	assert.Tf(t, method == "GET" && ct == 3, "sorted by count: %v %v", method, ct)
+	method, _ = r.GetString(1, 0)
+	avg, _ := r.GetFloat(1, 3)
+	assert.Tf(t, method == "POST" && avg == 9, "second row: %v %v", method, avg)
+}
+
+func TestEsAggregates(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := newTestEs(t, `{"hits": {"total": 6, "hits": []},
+	  "aggregations": {"m1": {"value": 12.5}, "m2": {"value": 4}}}`, &bodies)
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+
+	r := runQuery(t, h, "select count(*), sum(latency), count(distinct user) from logs")
+	by, _ := json.Marshal(bodies[0]["aggs"])
+	assert.Tf(t, string(by) == `{"m1":{"sum":{"field":"latency"}},"m2":{"cardinality":{"field":"user"}}}`,
+		"must send metric aggs: %s", string(by))
+	assert.Tf(t, r.RowNumber() == 1, "one row without group by: %v", r.RowNumber())
+	ct, _ := r.GetInt(0, 0)
+	sum, _ := r.GetFloat(0, 1)
+	users, _ := r.GetInt(0, 2)
+	assert.Tf(t, ct == 6 && sum == 12.5 && users == 4, "values: %v %v %v", ct, sum, users)
+
+	for _, sql := range []string{
+		"select path, count(*) from logs group by status",
+		"select count(*) from logs group by status having count(*) > 1",
+		"select concat(path) from logs",
+	} {
+		w := &testResultWriter{}
+		err := h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, sql...)})
+		assert.Tf(t, err != nil, "must not support %s", sql)
+	}
+}
+
+var testMapping = `{
+  "logs-2015.06": {"mappings": {"log": {"properties": {
+    "status": {"type": "long"},
+    "path": {"type": "string", "index": "not_analyzed"},
+    "user": {"properties": {"name": {"type": "string"}, "age": {"type": "integer"}}}
+  }}}},
+  "logs-2015.07": {"mappings": {"log": {"properties": {
+    "latency": {"type": "double"},
+    "created": {"type": "date"},
+    "location": {"type": "geo_point"}
+  }}}}
+}`
+
+// a fake elasticsearch answering by request path
+func newTestEsPaths(t *testing.T, paths map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := paths[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, `{"error":"IndexMissingException[[%s] missing]","status":404}`, r.URL.Path)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, resp)
+	}))
+}
+
+func TestEsShowTables(t *testing.T) {
+	ts := newTestEsPaths(t, map[string]string{
+		"/_aliases": `{"logs-2015.06": {"aliases": {"logs": {}}}, "logs-2015.07": {"aliases": {"logs": {}}},
+		  "users": {"aliases": {}}, ".kibana": {"aliases": {}}}`,
+	})
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+
+	r := runQuery(t, h, "show tables")
+	assert.Tf(t, string(r.Fields[0].Name) == "Tables_in_logs", "column name: %s", r.Fields[0].Name)
+	var tables []string
+	for i := 0; i < r.RowNumber(); i++ {
+		table, _ := r.GetString(i, 0)
+		tables = append(tables, table)
+	}
+	assert.Tf(t, strings.Join(tables, ",") == "logs,logs-2015.06,logs-2015.07,users", "indexes and aliases: %v", tables)
+
+	r = runQuery(t, h, "show tables from logs like 'logs-%'")
+	assert.Tf(t, r.RowNumber() == 2, "must filter tables: %v", r.RowNumber())
+}
+
+func TestEsDescribe(t *testing.T) {
+	ts := newTestEsPaths(t, map[string]string{"/logs/_mapping": testMapping})
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+
+	r := runQuery(t, h, "describe logs")
+	assert.Tf(t, len(r.Fields) == 6, "describe columns: %v", len(r.Fields))
+	cols := make(map[string]string)
+	for i := 0; i < r.RowNumber(); i++ {
+		name, _ := r.GetString(i, 0)
+		typ, _ := r.GetString(i, 1)
+		cols[name] = typ
+	}
+	assert.Tf(t, len(cols) == 7, "fields merged across indexes: %v", cols)
+	assert.Tf(t, cols["status"] == "bigint(20)", "long is bigint: %v", cols["status"])
+	assert.Tf(t, cols["user.age"] == "int(11)", "nested objects are flattened: %v", cols)
+	assert.Tf(t, cols["created"] == "datetime", "date is datetime: %v", cols["created"])
+	assert.Tf(t, cols["location"] == "text", "geo_point is text: %v", cols["location"])
+	first, _ := r.GetString(0, 0)
+	assert.Tf(t, first == "created", "sorted by name: %v", first)
+
+	r = runQuery(t, h, "show full columns from `logs`")
+	assert.Tf(t, r.RowNumber() == 7, "show columns: %v", r.RowNumber())
+
+	w := &testResultWriter{}
+	err := h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_FIELD_LIST}, "logs\x00"...)})
+	assert.Tf(t, err == nil, "field list: %v", err)
+	assert.Tf(t, len(w.fields) == 1 && len(w.fields[0]) == 7, "must write field list: %v", w.fields)
+	f := w.fields[0][3]
+	assert.Tf(t, string(f.Name) == "path" && string(f.Table) == "logs", "field name: %s", f.Name)
+	assert.Tf(t, f.Type == mysql.MYSQL_TYPE_VAR_STRING && f.Charset == 33, "string field: %v", f.Type)
+
+	err = h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, "describe nope"...)})
+	assert.T(t, err != nil, "must error on missing index")
+}
+
+// Grants of a connection to some schemas
+type testGrants []string
+
+func (m testGrants) CanUseSchema(db string) bool {
+	for _, s := range m {
+		if s == db {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEsSchemaGrants(t *testing.T) {
+	ts := newTestEsPaths(t, map[string]string{})
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+	r := runQuery(t, h, "show databases")
+	assert.Tf(t, r.RowNumber() == 1, "all schemas without grants: %v", r.RowNumber())
+
+	h = h.Clone(testGrants{"other"}).(*HandlerElasticsearch)
+	r = runQuery(t, h, "show databases")
+	assert.Tf(t, r.RowNumber() == 0, "only granted schemas: %v", r.RowNumber())
+
+	w := &testResultWriter{}
+	err := h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, "show tables from logs"...)})
+	assert.Tf(t, err != nil, "must not show tables of schemas without grants")
+}
+
+func TestEsGroupByTooManyGroups(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := newTestEs(t, `{"hits": {"total": 5000, "hits": []},
+	  "aggregations": {"g0": {"sum_other_doc_count": 12, "buckets": [{"key": "GET", "doc_count": 3}]}}}`, &bodies)
+	defer ts.Close()
+
+	h := newTestHandler(t, ts.URL)
+	w := &testResultWriter{}
+	err := h.Handle(w, &models.Request{Raw: append([]byte{mysql.COM_QUERY}, "select method, count(*) from logs group by method"...)})
+	assert.Tf(t, err != nil, "must error, not return partial groups")
+}
@@ -0,0 +1,220 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/araddon/dataux/vendor/mixer/sqlparser"
+)
+
+/*
+Translate a sql WHERE clause into an elasticsearch query
+
+	a = 1                  {"term": {"a": 1}}
+	a != 1                 {"bool": {"must_not": {"term": {"a": 1}}}}
+	a > 1                  {"range": {"a": {"gt": 1}}}
+	a between 1 and 5      {"range": {"a": {"gte": 1, "lte": 5}}}
+	a in (1,2)             {"terms": {"a": [1, 2]}}
+	a like 'b%'            {"wildcard": {"a": "b*"}}
+	a is not null          {"exists": {"field": "a"}}
+	x and y                {"bool": {"must": [x, y]}}
+	x or y                 {"bool": {"should": [x, y], "minimum_should_match": 1}}
+	not x                  {"bool": {"must_not": x}}
+*/
+
+// reversed comparison operators, for when the literal is on the left
+var flippedOps = map[string]string{
+	sqlparser.AST_LT: sqlparser.AST_GT,
+	sqlparser.AST_LE: sqlparser.AST_GE,
+	sqlparser.AST_GT: sqlparser.AST_LT,
+	sqlparser.AST_GE: sqlparser.AST_LE,
+}
+
+var rangeOps = map[string]string{
+	sqlparser.AST_LT: "lt",
+	sqlparser.AST_LE: "lte",
+	sqlparser.AST_GT: "gt",
+	sqlparser.AST_GE: "gte",
+}
+
+func whereQuery(expr sqlparser.BoolExpr) (map[string]interface{}, error) {
+	switch e := expr.(type) {
+	case *sqlparser.AndExpr:
+		left, right, err := whereQueries(e.Left, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		return boolQuery("must", []interface{}{left, right}), nil
+	case *sqlparser.OrExpr:
+		left, right, err := whereQueries(e.Left, e.Right)
+		if err != nil {
+			return nil, err
+		}
+		q := boolQuery("should", []interface{}{left, right})
+		q["bool"].(map[string]interface{})["minimum_should_match"] = 1
+		return q, nil
+	case *sqlparser.NotExpr:
+		q, err := whereQuery(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return boolQuery("must_not", q), nil
+	case *sqlparser.ParenBoolExpr:
+		return whereQuery(e.Expr)
+	case *sqlparser.NullCheck:
+		field, err := queryField(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		q := map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+		if e.Operator == sqlparser.AST_IS_NULL {
+			return boolQuery("must_not", q), nil
+		}
+		return q, nil
+	case *sqlparser.RangeCond:
+		field, err := queryField(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		from, err := queryValue(e.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := queryValue(e.To)
+		if err != nil {
+			return nil, err
+		}
+		q := map[string]interface{}{"range": map[string]interface{}{
+			field: map[string]interface{}{"gte": from, "lte": to},
+		}}
+		if e.Operator == sqlparser.AST_NOT_BETWEEN {
+			return boolQuery("must_not", q), nil
+		}
+		return q, nil
+	case *sqlparser.ComparisonExpr:
+		return comparisonQuery(e)
+	}
+	return nil, fmt.Errorf("unsupported where expression for elasticsearch: %s", nstring(expr))
+}
+
+func whereQueries(left, right sqlparser.BoolExpr) (map[string]interface{}, map[string]interface{}, error) {
+	lq, err := whereQuery(left)
+	if err != nil {
+		return nil, nil, err
+	}
+	rq, err := whereQuery(right)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lq, rq, nil
+}
+
+func boolQuery(clause string, q interface{}) map[string]interface{} {
+	return map[string]interface{}{"bool": map[string]interface{}{clause: q}}
+}
+
+func comparisonQuery(e *sqlparser.ComparisonExpr) (map[string]interface{}, error) {
+
+	op := e.Operator
+	left, right := e.Left, e.Right
+	if !sqlparser.IsColName(left) && sqlparser.IsColName(right) {
+		// 5 < a   is   a > 5
+		left, right = right, left
+		if flipped, ok := flippedOps[op]; ok {
+			op = flipped
+		}
+	}
+
+	field, err := queryField(left)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case sqlparser.AST_IN, sqlparser.AST_NOT_IN:
+		tuple, ok := right.(sqlparser.ValTuple)
+		if !ok {
+			return nil, fmt.Errorf("unsupported in expression for elasticsearch: %s", nstring(e))
+		}
+		vals := make([]interface{}, len(tuple))
+		for i, val := range tuple {
+			if vals[i], err = queryValue(val); err != nil {
+				return nil, err
+			}
+		}
+		q := map[string]interface{}{"terms": map[string]interface{}{field: vals}}
+		if op == sqlparser.AST_NOT_IN {
+			return boolQuery("must_not", q), nil
+		}
+		return q, nil
+	case sqlparser.AST_LIKE, sqlparser.AST_NOT_LIKE:
+		pattern, ok := right.(sqlparser.StrVal)
+		if !ok {
+			return nil, fmt.Errorf("like requires a string pattern: %s", nstring(e))
+		}
+		q := map[string]interface{}{"wildcard": map[string]interface{}{field: likeToWildcard(string(pattern))}}
+		if op == sqlparser.AST_NOT_LIKE {
+			return boolQuery("must_not", q), nil
+		}
+		return q, nil
+	}
+
+	val, err := queryValue(right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case sqlparser.AST_EQ, sqlparser.AST_NSE:
+		return map[string]interface{}{"term": map[string]interface{}{field: val}}, nil
+	case sqlparser.AST_NE, "<>":
+		return boolQuery("must_not", map[string]interface{}{"term": map[string]interface{}{field: val}}), nil
+	case sqlparser.AST_LT, sqlparser.AST_LE, sqlparser.AST_GT, sqlparser.AST_GE:
+		return map[string]interface{}{"range": map[string]interface{}{
+			field: map[string]interface{}{rangeOps[op]: val},
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q for elasticsearch: %s", op, nstring(e))
+}
+
+func queryField(expr sqlparser.ValExpr) (string, error) {
+	if col, ok := expr.(*sqlparser.ColName); ok {
+		return string(col.Name), nil
+	}
+	return "", fmt.Errorf("expected a field name but got: %s", nstring(expr))
+}
+
+func queryValue(expr sqlparser.ValExpr) (interface{}, error) {
+	switch e := expr.(type) {
+	case sqlparser.StrVal:
+		return string(e), nil
+	case sqlparser.NumVal:
+		return json.Number(string(e)), nil
+	}
+	return nil, fmt.Errorf("expected a literal value but got: %s", nstring(expr))
+}
+
+// Convert a sql like pattern into an es wildcard, % is * and _ is ?
+func likeToWildcard(pattern string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				buf.WriteByte(pattern[i])
+			}
+		case '%':
+			buf.WriteByte('*')
+		case '_':
+			buf.WriteByte('?')
+		case '*', '?':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/lytics/confl"
 	"io/ioutil"
+	"strings"
 )
 
 func LoadConfigFromFile(filename string) (*Config, error) {
@@ -36,6 +37,54 @@ type Config struct {
 	Frontends      []*ListenerConfig `json:"frontends"`       // tcp listener configs
 	Backends       []*BackendConfig  `json:"backends"`        // backend servers (es, mysql etc)
 	Schemas        []*SchemaConfig   `json:"schemas"`         // virtual schema
+	XALog          string            `json:"xa_log"`          // log file of xa transactions, for schemas with xa
+	ReshardLog     string            `json:"reshard_log"`     // file of the rules switched by resharding
+	Users          []*UserConfig     `json:"users"`           // frontend users, if none any user with the listener password
+}
+
+// A user of the frontends and the schemas it may use
+type UserConfig struct {
+	User     string   `json:"user"`
+	Password string   `json:"password"` // hash of the password, "*" and the hex SHA1(SHA1(password)) of mysql PASSWORD()
+	Schemas  []string `json:"schemas"`  // schemas the user may use, "*" for all
+	// statements and tables the user may use, tables as table for the
+	// table of any schema or db.table
+	ReadOnly   bool     `json:"read_only"`   // no writes, ddl or admin statements
+	NoDDL      bool     `json:"no_ddl"`      // no create, alter, drop, rename or admin statements
+	Tables     []string `json:"tables"`      // tables the user may use, all if none
+	DenyTables []string `json:"deny_tables"` // tables the user may not use
+}
+
+// CanUse is true if the user may use schema @db
+func (m *UserConfig) CanUse(db string) bool {
+	for _, s := range m.Schemas {
+		if s == "*" || s == db {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted is true for users with rules on statements or tables
+func (m *UserConfig) Restricted() bool {
+	return m.ReadOnly || m.NoDDL || len(m.Tables) > 0 || len(m.DenyTables) > 0
+}
+
+// CanUseTable is true if the user may use @table of schema @db
+func (m *UserConfig) CanUseTable(db, table string) bool {
+	if len(m.Tables) > 0 && !matchTable(m.Tables, db, table) {
+		return false
+	}
+	return !matchTable(m.DenyTables, db, table)
+}
+
+func matchTable(tables []string, db, table string) bool {
+	for _, t := range tables {
+		if strings.EqualFold(t, table) || strings.EqualFold(t, db+"."+table) {
+			return true
+		}
+	}
+	return false
 }
 
 // Backends are storage/database/servers/csvfiles
@@ -50,6 +99,15 @@ type BackendConfig struct {
 	Password         string `json:"password"`
 	Master           string `json:"master"`
 	Slave            string `json:"slave"`
+	// tls to the servers, "preferred" if the server offers it or
+	// "required", with the pem files of the CA to verify the server and
+	// of an optional client certificate and key
+	TLS           string `json:"tls"`
+	TLSCA         string `json:"tls_ca"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	TLSServerName string `json:"tls_server_name"` // name in the server certificate, else the host of its address
+	TLSSkipVerify bool   `json:"tls_skip_verify"` // don't verify the server certificate
 }
 
 func (m *BackendConfig) String() string {
@@ -63,6 +121,16 @@ type ListenerConfig struct {
 	Addr     string `json:"addr"`     // net.Conn compatible ip/dns address
 	User     string `json:"user"`     // user to talk to backend with
 	Password string `json:"password"` // optional pwd for backend
+	// tls of client connections, with the pem files of the certificate
+	// and key of the listener, and of the CA to verify client certificates
+	TLSCert    string `json:"tls_cert"`
+	TLSKey     string `json:"tls_key"`
+	TLSCA      string `json:"tls_ca"`
+	TLSRequire bool   `json:"tls_require"`     // refuse clients not using tls
+	ClientCert bool   `json:"tls_client_cert"` // clients must have a certificate signed by the CA
+	// auth plugin asked of clients, mysql_native_password (default)
+	// or caching_sha2_password
+	AuthPlugin string `json:"auth_plugin"`
 }
 
 type SchemaConfig struct {
@@ -70,6 +138,7 @@ type SchemaConfig struct {
 	DB          string      `json:"db"`
 	Backends    []string    `json:"backends"`
 	RulesConifg RulesConfig `json:"rules"`
+	XA          bool        `json:"xa"` // two phase commit of multi-shard writes with mysql xa
 }
 
 func (m *SchemaConfig) String() string {
@@ -77,14 +146,53 @@ func (m *SchemaConfig) String() string {
 }
 
 type RulesConfig struct {
-	Default   string        `json:"default"`
-	ShardRule []ShardConfig `json:"shard"`
+	Default   string             `json:"default"`
+	ShardRule []ShardConfig      `json:"shard"`
+	Groups    []TableGroupConfig `json:"groups"`
 }
 
-type ShardConfig struct {
-	Table    string   `json:"table"`
-	Key      string   `json:"key"`
+// TableGroupConfig shards a group of tables alike, by one key and shard
+// function, so the rows of the tables with the same key are on one node
+// and joins of the tables on the key stay on that node
+type TableGroupConfig struct {
+	Name     string   `json:"name"`
+	Tables   []string `json:"tables"`
+	Key      string   `json:"key"` // the key column, of every table of the group
 	Backends []string `json:"backends"`
 	Type     string   `json:"type"`
 	Range    string   `json:"range"`
+	KeyType  string   `json:"key_type"`
+	Vindex   string   `json:"vindex"`
+	VBuckets int      `json:"vbuckets"`
+	Buckets  []string `json:"buckets"`
+}
+
+// ShardConfig is the shard config of @table of the group
+func (m *TableGroupConfig) ShardConfig(table string) ShardConfig {
+	return ShardConfig{
+		Table:    table,
+		Key:      m.Key,
+		Backends: m.Backends,
+		Type:     m.Type,
+		Range:    m.Range,
+		KeyType:  m.KeyType,
+		Vindex:   m.Vindex,
+		VBuckets: m.VBuckets,
+		Buckets:  m.Buckets,
+	}
+}
+
+type ShardConfig struct {
+	Table    string   `json:"table"`
+	Key      string   `json:"key"` // column, composite "tenant_id, user_id", or crc32, lower or year of a column
+	Backends []string `json:"backends"`
+	Type     string   `json:"type"`     // hash, range, vbucket, keyrange or global
+	Range    string   `json:"range"`    // range boundaries, or hex keyspace id ranges for keyrange "-80-c0-"
+	KeyType  string   `json:"key_type"` // key type for range: int (default), string (case insensitive), binary or date
+	Vindex   string   `json:"vindex"`   // keyspace id of keyrange keys: hash (integers, default) or binary_md5
+	VBuckets int      `json:"vbuckets"` // number of virtual buckets for vbucket, default 1024
+	Buckets  []string `json:"buckets"`  // buckets of each backend for vbucket, "0-511"
+	// AutoIncrement is the id column the proxy fills in from a sequence
+	// instead of the auto_increment of each backend
+	AutoIncrement string `json:"auto_increment"`
 }
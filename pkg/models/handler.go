@@ -1,7 +1,11 @@
 package models
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/araddon/dataux/vendor/mixer/sqlparser"
+	u "github.com/araddon/gou"
 )
 
 type Request struct {
@@ -22,8 +26,39 @@ type HandlerSession interface {
 	Clone(conn interface{}) Handler
 }
 
+// SchemaGrants is implemented by connections whose user may only use
+// some schemas, handlers show them only those
+type SchemaGrants interface {
+	CanUseSchema(db string) bool
+}
+
 type ResultWriter interface {
 	WriteResult(Result) error
 }
 
 type Result interface{}
+
+var (
+	handlerMu    sync.Mutex
+	handlerFuncs = make(map[string]HandlerInit)
+)
+
+// HandlerInit creates the Handler for a backend_type, such as elasticsearch
+// which is used for schemas of that backend_type
+type HandlerInit func(*Config) (Handler, error)
+
+// Register a Handler for schemas of a given backend_type
+func HandlerRegister(backendType string, fn HandlerInit) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	backendType = strings.ToLower(backendType)
+	u.Infof("registering handler [%s] ", backendType)
+	handlerFuncs[backendType] = fn
+}
+
+// Find the registered Handler init for a backend_type
+func HandlerFind(backendType string) HandlerInit {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	return handlerFuncs[strings.ToLower(backendType)]
+}